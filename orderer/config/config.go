@@ -0,0 +1,74 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import "time"
+
+// TopLevel conveys all configuration for an orderer process.
+type TopLevel struct {
+	General General
+	Kafka   Kafka
+}
+
+// General contains configuration common to every orderer implementation.
+type General struct {
+	// BatchSize is the maximum number of messages to include in a block
+	// before cutting it, regardless of PreferredMaxBytes.
+	BatchSize uint
+	// BatchTimeout is the longest a block is allowed to accumulate
+	// messages before it is cut, even if neither size threshold is met.
+	BatchTimeout time.Duration
+	// PreferredMaxBytes is the batch cutter's target size, in bytes, for
+	// the serialized message data in a block. A block is cut early if the
+	// next message would push it past this threshold, and an individual
+	// message larger than this is rejected outright.
+	PreferredMaxBytes uint32
+}
+
+// Kafka contains configuration for reaching, and talking to, the Kafka
+// cluster that backs the ordering log. Each channel owns its own topic, so
+// no single topic is named here.
+type Kafka struct {
+	Brokers []string
+	// Compression selects the codec Kafka messages are compressed with:
+	// "none", "gzip", or "snappy". Defaults to "none".
+	Compression string
+	Retry       Retry
+}
+
+// Retry governs how the Producer responds to a failed send: how many times
+// (and with what backoff) it retries a given message before giving up on
+// it, and the circuit breaker that trips after repeated failures so a
+// struggling broker doesn't get hammered with retries indefinitely.
+type Retry struct {
+	// MaxRetries is how many times a failed send is retried before the
+	// message is given up on and reported as an error.
+	MaxRetries int
+	// Backoff is the base delay before the first retry; each subsequent
+	// retry doubles it, plus jitter.
+	Backoff time.Duration
+	// BreakerErrorThreshold is the number of consecutive send failures
+	// that trips the circuit breaker.
+	BreakerErrorThreshold int
+	// BreakerSuccessThreshold is the number of consecutive successful
+	// probes required, once the breaker has half-opened, before it
+	// closes again.
+	BreakerSuccessThreshold int
+	// BreakerTimeout is how long the breaker stays open before allowing
+	// a single probe send through.
+	BreakerTimeout time.Duration
+}
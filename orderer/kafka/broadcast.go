@@ -17,7 +17,6 @@ limitations under the License.
 package kafka
 
 import (
-	"fmt"
 	"sync"
 	"time"
 
@@ -33,118 +32,340 @@ type Broadcaster interface {
 	Closeable
 }
 
+// batchedMessage is a single client request waiting to be cut into a block.
+// acks is the reply channel belonging to the stream that submitted it; it
+// rides along to the eventual Kafka message's Metadata so the dispatcher
+// can deliver the outcome back to the right client once the block lands.
+type batchedMessage struct {
+	message *ab.BroadcastMessage
+	acks    chan<- *ab.BroadcastResponse
+}
+
+// blockMetadata is attached to every block handed to the Producer. It
+// carries the ack channel of each message the block contains, in order, so
+// that a single Kafka acknowledgement can be fanned out to every client
+// waiting on it.
+type blockMetadata struct {
+	acks []chan<- *ab.BroadcastResponse
+}
+
+// broadcasterImpl demuxes incoming client messages to a per-channel
+// manager, creating one the first time a given channel ID is seen. Each
+// channel owns its own cutter goroutine, batch state and hash chain, and
+// targets its own Kafka topic/partition, so one orderer process can front
+// many logical ledgers over a single Kafka cluster.
 type broadcasterImpl struct {
 	producer Producer
 	config   *config.TopLevel
-	once     sync.Once
 
-	batchChan  chan *ab.BroadcastMessage
-	messages   [][]byte
-	nextNumber uint64
-	prevHash   []byte
+	channels sync.Map // channel ID (string) -> *channelState
+}
+
+// channelState is the mutable state for a single logical channel: its
+// pending batch, hash chain, and the goroutine that cuts blocks for it.
+type channelState struct {
+	parent *broadcasterImpl
+	id     string
+
+	batchChan   chan *batchedMessage
+	messages    [][]byte
+	pendingAcks []chan<- *ab.BroadcastResponse
+	nextNumber  uint64
+	prevHash    []byte
+
+	done chan struct{}
 }
 
 func newBroadcaster(conf *config.TopLevel) Broadcaster {
-	return &broadcasterImpl{
-		producer:   newProducer(conf),
-		config:     conf,
-		batchChan:  make(chan *ab.BroadcastMessage, conf.General.BatchSize),
-		messages:   [][]byte{[]byte("genesis")},
-		nextNumber: 0,
+	b := &broadcasterImpl{
+		producer: newProducer(conf),
+		config:   conf,
 	}
+	go b.dispatchAcks()
+	return b
 }
 
 // Broadcast receives ordering requests by clients and sends back an
 // acknowledgement for each received message in order, indicating
 // success or type of failure
 func (b *broadcasterImpl) Broadcast(stream ab.AtomicBroadcast_BroadcastServer) error {
-	b.once.Do(func() {
-		// Send the genesis block to create the topic
-		// otherwise consumers will throw an exception.
-		b.sendBlock()
-		// Spawn the goroutine that cuts blocks
-		go b.cutBlock(b.config.General.BatchTimeout, b.config.General.BatchSize)
-	})
 	return b.recvRequests(stream)
 }
 
-// Close shuts down the broadcast side of the orderer
+// Close shuts down the broadcast side of the orderer, stopping every
+// channel's cutter goroutine before closing the shared Producer.
 func (b *broadcasterImpl) Close() error {
+	b.channels.Range(func(_, value interface{}) bool {
+		close(value.(*channelState).done)
+		return true
+	})
 	if b.producer != nil {
 		return b.producer.Close()
 	}
 	return nil
 }
 
-func (b *broadcasterImpl) sendBlock() error {
+// getOrCreateChannel returns the channelState for id, creating it (and
+// spawning its cutter goroutine) the first time id is seen. sync.Map, not
+// the broadcaster-wide sync.Once this replaces, lets every channel start up
+// independently of the others.
+func (b *broadcasterImpl) getOrCreateChannel(id string) *channelState {
+	if v, ok := b.channels.Load(id); ok {
+		return v.(*channelState)
+	}
+
+	cs := &channelState{
+		parent:    b,
+		id:        id,
+		batchChan: make(chan *batchedMessage, b.config.General.BatchSize),
+		done:      make(chan struct{}),
+	}
+
+	actual, loaded := b.channels.LoadOrStore(id, cs)
+	cs = actual.(*channelState)
+	if !loaded {
+		cs.recoverChainState()
+		if cs.nextNumber == 0 {
+			// Nothing recovered from Kafka: send the genesis block to create
+			// the topic, otherwise consumers will throw an exception.
+			cs.messages = [][]byte{[]byte("genesis")}
+			cs.sendBlock()
+		}
+		go cs.cutBlock(b.config.General.BatchTimeout, b.config.General.BatchSize)
+	}
+	return cs
+}
+
+// recoverChainState consults this channel's own Kafka topic to discover
+// where the chain left off, so a restarted process (or a second orderer
+// fronting the same topic) picks up nextNumber/prevHash from what is
+// actually on Kafka instead of always restarting from genesis.
+func (cs *channelState) recoverChainState() {
+	consumer, err := newConsumer(cs.parent.config, cs.id, OldestOffset)
+	if err != nil {
+		logger.Warningf("Channel %s: cannot reach Kafka to recover chain state, starting from genesis: %s", cs.id, err)
+		return
+	}
+	defer consumer.Close()
+
+	hwm := consumer.part.HighWaterMarkOffset()
+	if hwm == 0 {
+		// Nothing has ever been written to this topic (the common case for
+		// a brand-new channel, whose topic Kafka may have just auto-created
+		// for us on ConsumePartition): there is nothing to range over, so
+		// don't block waiting for a message that will never arrive.
+		logger.Debugf("Channel %s: topic is empty, nothing to recover", cs.id)
+		return
+	}
+
+	for {
+		select {
+		case msg, ok := <-consumer.part.Messages():
+			if !ok {
+				logger.Warningf("Channel %s: Kafka partition consumer closed while recovering chain state", cs.id)
+				return
+			}
+			block := &ab.Block{}
+			if err := proto.Unmarshal(msg.Value, block); err != nil {
+				logger.Warningf("Channel %s: skipping unparsable block at Kafka offset %d: %s", cs.id, msg.Offset, err)
+			} else {
+				cs.nextNumber = block.Header.Number + 1
+				cs.prevHash = block.Header.Hash()
+			}
+			if msg.Offset+1 >= hwm {
+				logger.Infof("Channel %s: recovered chain state from Kafka, next block is %d", cs.id, cs.nextNumber)
+				return
+			}
+		case kerr, ok := <-consumer.part.Errors():
+			if !ok {
+				return
+			}
+			logger.Warningf("Channel %s: error recovering chain state from Kafka: %s", cs.id, kerr.Err)
+			return
+		}
+	}
+}
+
+// sendBlock cuts the currently accumulated messages into a block and hands
+// it to the Producer, targeting this channel's own Kafka topic and tagging
+// it with the ack channels of every message it contains. It does not learn
+// here whether the send succeeded: that is dispatchAcks' job, once Kafka
+// actually confirms it.
+func (cs *channelState) sendBlock() {
 	data := &ab.BlockData{
-		Data: b.messages,
+		Data: cs.messages,
 	}
 	block := &ab.Block{
 		Header: &ab.BlockHeader{
-			Number:       b.nextNumber,
-			PreviousHash: b.prevHash,
+			Number:       cs.nextNumber,
+			PreviousHash: cs.prevHash,
 			DataHash:     data.Hash(),
 		},
 		Data: data,
 	}
-	logger.Debugf("Prepared block %d with %d messages (%+v)", block.Header.Number, len(block.Data.Data), block)
+	logger.Debugf("Channel %s: prepared block %d with %d messages (%+v)", cs.id, block.Header.Number, len(block.Data.Data), block)
 
-	b.messages = [][]byte{}
-	b.nextNumber++
-	b.prevHash = block.Header.Hash()
+	acks := cs.pendingAcks
+	cs.messages = [][]byte{}
+	cs.pendingAcks = nil
+	cs.nextNumber++
+	cs.prevHash = block.Header.Hash()
 
 	blockBytes, err := proto.Marshal(block)
-
 	if err != nil {
 		logger.Fatalf("Error marshaling block: %s", err)
 	}
 
-	return b.producer.Send(blockBytes)
+	cs.parent.producer.Input() <- &ProducerMessage{
+		Topic:    cs.id,
+		Value:    blockBytes,
+		Metadata: &blockMetadata{acks: acks},
+	}
 }
 
-func (b *broadcasterImpl) cutBlock(period time.Duration, maxSize uint) {
+func (cs *channelState) cutBlock(period time.Duration, maxSize uint) {
 	timer := time.NewTimer(period)
+	var pendingBytes uint32
 
 	for {
+		if !cs.parent.producer.Ready() {
+			// The circuit breaker is open: stop draining batchChan so that
+			// recvRequests backs off instead of handing Kafka more work it
+			// has just shown it can't handle. Resumes on its own once the
+			// breaker half-opens and a probe send succeeds.
+			select {
+			case <-timer.C:
+				timer.Reset(period)
+			case <-cs.done:
+				timer.Stop()
+				return
+			}
+			continue
+		}
+
 		select {
-		case msg := <-b.batchChan:
-			b.messages = append(b.messages, msg.Data)
-			if len(b.messages) >= int(maxSize) {
+		case entry := <-cs.batchChan:
+			msgSize := uint32(len(entry.message.Data))
+			maxBytes := cs.parent.config.General.PreferredMaxBytes
+
+			if maxBytes > 0 && msgSize > maxBytes {
+				logger.Debugf("Channel %s: rejecting message of %d bytes: exceeds PreferredMaxBytes of %d", cs.id, msgSize, maxBytes)
+				entry.acks <- &ab.BroadcastResponse{Status: ab.Status_BAD_REQUEST}
+				continue
+			}
+
+			if maxBytes > 0 && len(cs.messages) > 0 && pendingBytes+msgSize > maxBytes {
 				if !timer.Stop() {
 					<-timer.C
 				}
 				timer.Reset(period)
-				if err := b.sendBlock(); err != nil {
-					panic(fmt.Errorf("Cannot communicate with Kafka broker: %s", err))
+				cs.sendBlock()
+				pendingBytes = 0
+			}
+
+			cs.messages = append(cs.messages, entry.message.Data)
+			cs.pendingAcks = append(cs.pendingAcks, entry.acks)
+			pendingBytes += msgSize
+
+			if len(cs.messages) >= int(maxSize) {
+				if !timer.Stop() {
+					<-timer.C
 				}
+				timer.Reset(period)
+				cs.sendBlock()
+				pendingBytes = 0
 			}
 		case <-timer.C:
 			timer.Reset(period)
-			if len(b.messages) > 0 {
-				if err := b.sendBlock(); err != nil {
-					panic(fmt.Errorf("Cannot communicate with Kafka broker: %s", err))
-				}
+			if len(cs.messages) > 0 {
+				cs.sendBlock()
+				pendingBytes = 0
 			}
+		case <-cs.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// dispatchAcks drains the Producer's Successes/Errors channels and fans the
+// outcome of each block back out to every client stream waiting on it, only
+// once Kafka has actually told us what happened to it. A single dispatcher
+// serves every channel, since they all share one Producer.
+func (b *broadcasterImpl) dispatchAcks() {
+	for {
+		select {
+		case msg, ok := <-b.producer.Successes():
+			if !ok {
+				return
+			}
+			b.ackAll(msg.Metadata.(*blockMetadata), ab.Status_SUCCESS)
+		case pe, ok := <-b.producer.Errors():
+			if !ok {
+				return
+			}
+			logger.Errorf("Failed to send block to Kafka: %s", pe.Err)
+			b.ackAll(pe.Msg.Metadata.(*blockMetadata), ab.Status_SERVICE_UNAVAILABLE)
+		}
+	}
+}
+
+// ackAll fans a block's outcome out to every client waiting on it. The send
+// to each ack channel is non-blocking: it is sized to that stream's
+// BatchSize and drained continuously by sendReplies, so it only fills up
+// when a client has stopped reading entirely. Blocking here would stall
+// dispatchAcks, the single dispatcher every channel shares, turning one
+// stuck client into a pipeline-wide outage instead of that client's own
+// problem.
+func (b *broadcasterImpl) ackAll(md *blockMetadata, status ab.Status) {
+	reply := &ab.BroadcastResponse{Status: status}
+	for _, acks := range md.acks {
+		select {
+		case acks <- reply:
+		default:
+			logger.Warningf("Dropping broadcast ack: client is not draining replies")
 		}
 	}
 }
 
 func (b *broadcasterImpl) recvRequests(stream ab.AtomicBroadcast_BroadcastServer) error {
-	reply := new(ab.BroadcastResponse)
+	acks := make(chan *ab.BroadcastResponse, b.config.General.BatchSize)
+	done := make(chan struct{})
+	go sendReplies(stream, acks, done)
+
 	for {
 		msg, err := stream.Recv()
 		if err != nil {
 			logger.Debug("Can no longer receive requests from client (exited?)")
+			close(acks)
 			return err
 		}
 
-		b.batchChan <- msg
-		reply.Status = ab.Status_SUCCESS // TODO This shouldn't always be a success
+		cs := b.getOrCreateChannel(msg.ChannelId)
+		if !b.producer.Ready() {
+			// The circuit breaker is open and cutBlock has stopped draining
+			// this channel's batchChan: don't pile more messages up behind
+			// it, tell the client now instead of making it wait.
+			acks <- &ab.BroadcastResponse{Status: ab.Status_SERVICE_UNAVAILABLE}
+			continue
+		}
+
+		select {
+		case cs.batchChan <- &batchedMessage{message: msg, acks: acks}:
+		case <-done:
+			return nil
+		}
+	}
+}
 
+// sendReplies relays acknowledgements back to a single client stream, in
+// the order they were queued, without blocking recvRequests on Kafka.
+func sendReplies(stream ab.AtomicBroadcast_BroadcastServer, acks <-chan *ab.BroadcastResponse, done chan<- struct{}) {
+	defer close(done)
+	for reply := range acks {
 		if err := stream.Send(reply); err != nil {
 			logger.Info("Cannot send broadcast reply to client")
-			return err
+			return
 		}
 		logger.Debugf("Sent broadcast reply %v to client", reply.Status.String())
 	}
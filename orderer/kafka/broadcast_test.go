@@ -0,0 +1,92 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	ab "github.com/hyperledger/fabric/orderer/atomicbroadcast"
+	"github.com/hyperledger/fabric/orderer/config"
+)
+
+// fakeProducer is an in-memory Producer that acknowledges every message
+// handed to it as soon as it is sent, so dispatchAcks can be driven without
+// a real Kafka broker.
+type fakeProducer struct {
+	input     chan *ProducerMessage
+	successes chan *ProducerMessage
+	errors    chan *ProducerError
+}
+
+func newFakeProducer() *fakeProducer {
+	return &fakeProducer{
+		input:     make(chan *ProducerMessage, 8),
+		successes: make(chan *ProducerMessage, 8),
+		errors:    make(chan *ProducerError, 8),
+	}
+}
+
+func (f *fakeProducer) Input() chan<- *ProducerMessage     { return f.input }
+func (f *fakeProducer) Successes() <-chan *ProducerMessage { return f.successes }
+func (f *fakeProducer) Errors() <-chan *ProducerError      { return f.errors }
+func (f *fakeProducer) Ready() bool                        { return true }
+func (f *fakeProducer) Close() error                       { close(f.input); return nil }
+
+// ack echoes every message handed to Input back out on Successes, standing
+// in for a Kafka broker that accepts everything immediately.
+func (f *fakeProducer) ack() {
+	for msg := range f.input {
+		f.successes <- msg
+	}
+}
+
+// TestTwoChannelsDontBlockEachOtherOnAck drives two channels' cutBlock
+// goroutines through one shared Producer and dispatcher, one of whose
+// clients never drains its acks. A stuck client must not be able to stall
+// the other channel's acknowledgements: they share dispatchAcks and the
+// Producer, but nothing else.
+func TestTwoChannelsDontBlockEachOtherOnAck(t *testing.T) {
+	producer := newFakeProducer()
+	go producer.ack()
+
+	conf := &config.TopLevel{General: config.General{BatchSize: 1, BatchTimeout: time.Hour}}
+	b := &broadcasterImpl{producer: producer, config: conf}
+	go b.dispatchAcks()
+
+	stuckAcks := make(chan *ab.BroadcastResponse) // unbuffered, never read: simulates a dead client
+	liveAcks := make(chan *ab.BroadcastResponse, 1)
+
+	stuckChannel := &channelState{parent: b, id: "stuck-channel", batchChan: make(chan *batchedMessage, 1), done: make(chan struct{})}
+	liveChannel := &channelState{parent: b, id: "live-channel", batchChan: make(chan *batchedMessage, 1), done: make(chan struct{})}
+	go stuckChannel.cutBlock(conf.General.BatchTimeout, conf.General.BatchSize)
+	go liveChannel.cutBlock(conf.General.BatchTimeout, conf.General.BatchSize)
+	defer close(stuckChannel.done)
+	defer close(liveChannel.done)
+
+	stuckChannel.batchChan <- &batchedMessage{message: &ab.BroadcastMessage{Data: []byte("stuck")}, acks: stuckAcks}
+	liveChannel.batchChan <- &batchedMessage{message: &ab.BroadcastMessage{Data: []byte("live")}, acks: liveAcks}
+
+	select {
+	case reply := <-liveAcks:
+		if reply.Status != ab.Status_SUCCESS {
+			t.Fatalf("unexpected status: %v", reply.Status)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("live-channel's ack was blocked by stuck-channel's unread ack channel")
+	}
+}
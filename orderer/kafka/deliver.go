@@ -0,0 +1,143 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	ab "github.com/hyperledger/fabric/orderer/atomicbroadcast"
+	"github.com/hyperledger/fabric/orderer/config"
+
+	"github.com/Shopify/sarama"
+	"github.com/golang/protobuf/proto"
+)
+
+// Offset identifies where a Deliverer should begin replaying the ordering
+// topic. The two sentinel values below mirror Sarama's own
+// OffsetOldest/OffsetNewest; any non-negative value is a literal Kafka
+// offset, which for this single-partition topic is also the block number.
+type Offset int64
+
+const (
+	OldestOffset Offset = Offset(sarama.OffsetOldest)
+	NewestOffset Offset = Offset(sarama.OffsetNewest)
+)
+
+// Deliverer lets a client replay blocks previously ordered onto Kafka.
+// newDeliverer is called once per channel by the orderer's gRPC server as
+// it registers an AtomicBroadcast_DeliverServer stream; that registration
+// lives outside this package, alongside the rest of the server's setup.
+type Deliverer interface {
+	Deliver(stream ab.AtomicBroadcast_DeliverServer) error
+	Closeable
+}
+
+// consumerImpl reads blocks off a single Kafka partition, verifying that
+// each one chains onto the last before making it available.
+type consumerImpl struct {
+	consumer sarama.Consumer
+	part     sarama.PartitionConsumer
+
+	mutex     sync.Mutex
+	lastBlock *ab.Block
+}
+
+func newConsumer(conf *config.TopLevel, topic string, offset Offset) (*consumerImpl, error) {
+	consumer, err := sarama.NewConsumer(conf.Kafka.Brokers, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to Kafka brokers: %s", err)
+	}
+
+	part, err := consumer.ConsumePartition(topic, 0, int64(offset))
+	if err != nil {
+		consumer.Close()
+		return nil, fmt.Errorf("cannot consume partition 0 of topic %s: %s", topic, err)
+	}
+
+	return &consumerImpl{consumer: consumer, part: part}, nil
+}
+
+// newDeliverer constructs a Deliverer that replays the given channel's
+// Kafka topic starting at the given offset.
+func newDeliverer(conf *config.TopLevel, channelID string, offset Offset) (Deliverer, error) {
+	return newConsumer(conf, channelID, offset)
+}
+
+// Deliver streams every block the consumer reads off Kafka to the client,
+// verifying each one chains onto the last before forwarding it.
+func (c *consumerImpl) Deliver(stream ab.AtomicBroadcast_DeliverServer) error {
+	for {
+		select {
+		case msg, ok := <-c.part.Messages():
+			if !ok {
+				return fmt.Errorf("Kafka partition consumer closed")
+			}
+
+			block := &ab.Block{}
+			if err := proto.Unmarshal(msg.Value, block); err != nil {
+				return fmt.Errorf("cannot unmarshal block at Kafka offset %d: %s", msg.Offset, err)
+			}
+
+			if err := c.checkChain(block); err != nil {
+				return err
+			}
+
+			if err := stream.Send(block); err != nil {
+				return err
+			}
+		case kerr, ok := <-c.part.Errors():
+			if !ok {
+				return fmt.Errorf("Kafka partition consumer closed")
+			}
+			return fmt.Errorf("error consuming Kafka partition: %s", kerr.Err)
+		}
+	}
+}
+
+// checkChain verifies that block continues the hash chain established by
+// the last block this consumer has seen, then records it as the new tip.
+func (c *consumerImpl) checkChain(block *ab.Block) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.lastBlock != nil && !bytes.Equal(block.Header.PreviousHash, c.lastBlock.Header.Hash()) {
+		return fmt.Errorf("block %d does not chain onto block %d: previous hash mismatch", block.Header.Number, c.lastBlock.Header.Number)
+	}
+	if !bytes.Equal(block.Header.DataHash, block.Data.Hash()) {
+		return fmt.Errorf("block %d failed data hash verification", block.Header.Number)
+	}
+
+	c.lastBlock = block
+	return nil
+}
+
+// Tip returns the most recently verified block, or nil if the consumer has
+// not yet recovered any state from Kafka.
+func (c *consumerImpl) Tip() *ab.Block {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lastBlock
+}
+
+func (c *consumerImpl) Close() error {
+	if err := c.part.Close(); err != nil {
+		return err
+	}
+	return c.consumer.Close()
+}
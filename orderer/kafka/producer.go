@@ -0,0 +1,275 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/hyperledger/fabric/orderer/config"
+
+	"github.com/Shopify/sarama"
+	"github.com/eapache/go-resiliency/breaker"
+)
+
+// ProducerMessage is the unit of work submitted on a Producer's Input
+// channel. Metadata is opaque to the Producer: it is echoed back unchanged
+// on the ProducerMessage delivered on Successes (or wrapped in the
+// ProducerError delivered on Errors), so the caller can match a Kafka
+// acknowledgement back to whatever it was sending.
+type ProducerMessage struct {
+	Topic    string
+	Value    []byte
+	Metadata interface{}
+}
+
+// ProducerError pairs a ProducerMessage that failed to reach Kafka with the
+// error that was returned for it.
+type ProducerError struct {
+	Msg *ProducerMessage
+	Err error
+}
+
+func (pe *ProducerError) Error() string {
+	return fmt.Sprintf("kafka: failed to produce message: %s", pe.Err)
+}
+
+// maxRetryBackoff caps the exponential backoff between retries, both to
+// keep a stuck message from waiting unreasonably long and to guard against
+// the doubling overflowing time.Duration on a large attempt count.
+const maxRetryBackoff = time.Minute
+
+// Producer models Sarama's AsyncProducer: work is submitted on Input and
+// its outcome is reported later, and separately, on Successes or Errors.
+// Unlike a synchronous Send, nothing here blocks on broker I/O. Ready
+// reports whether the circuit breaker is currently closed, i.e. whether the
+// Producer is willing to accept more work right now.
+type Producer interface {
+	Input() chan<- *ProducerMessage
+	Successes() <-chan *ProducerMessage
+	Errors() <-chan *ProducerError
+	Ready() bool
+	Closeable
+}
+
+// retryMetadata wraps the caller's own Metadata while a message is in
+// flight, so a failed send can be retried without losing track of how many
+// attempts it has already had.
+type retryMetadata struct {
+	attempt  int
+	original interface{}
+}
+
+type producerImpl struct {
+	producer sarama.AsyncProducer
+	retry    config.Retry
+	breaker  *breaker.Breaker
+
+	input     chan *ProducerMessage
+	retries   chan *sarama.ProducerMessage
+	successes chan *ProducerMessage
+	errors    chan *ProducerError
+	shutdown  chan struct{}
+	closed    chan struct{}
+}
+
+func newProducer(conf *config.TopLevel) Producer {
+	saramaConf := sarama.NewConfig()
+	saramaConf.Producer.Return.Successes = true
+	saramaConf.Producer.Return.Errors = true
+	saramaConf.Producer.RequiredAcks = sarama.WaitForAll
+	saramaConf.Producer.Compression = compressionCodec(conf.Kafka.Compression)
+
+	sp, err := sarama.NewAsyncProducer(conf.Kafka.Brokers, saramaConf)
+	if err != nil {
+		logger.Fatalf("Cannot connect to Kafka brokers: %s", err)
+	}
+
+	p := &producerImpl{
+		producer: sp,
+		retry:    conf.Kafka.Retry,
+		breaker: breaker.New(
+			conf.Kafka.Retry.BreakerErrorThreshold,
+			conf.Kafka.Retry.BreakerSuccessThreshold,
+			conf.Kafka.Retry.BreakerTimeout,
+		),
+		input:     make(chan *ProducerMessage),
+		retries:   make(chan *sarama.ProducerMessage),
+		successes: make(chan *ProducerMessage),
+		errors:    make(chan *ProducerError),
+		shutdown:  make(chan struct{}),
+		closed:    make(chan struct{}),
+	}
+
+	go p.loop()
+
+	return p
+}
+
+// compressionCodec maps the orderer's own "none"/"gzip"/"snappy" setting
+// onto the Sarama codec that actually compresses messages on the wire
+// (Sarama's snappy support is backed by github.com/golang/snappy).
+func compressionCodec(name string) sarama.CompressionCodec {
+	switch name {
+	case "gzip":
+		return sarama.CompressionGZIP
+	case "snappy":
+		return sarama.CompressionSnappy
+	default:
+		return sarama.CompressionNone
+	}
+}
+
+// loop shuttles outgoing messages into the wrapped Sarama producer and
+// relays its Successes/Errors back out, translating to and from our own
+// ProducerMessage type as it goes. A failed send is retried, with backoff,
+// up to retry.MaxRetries times before it is reported as an error; the
+// circuit breaker tracks consecutive failures across all of this and trips
+// to give a struggling broker room to recover.
+func (p *producerImpl) loop() {
+	defer close(p.closed)
+	for {
+		select {
+		case msg, ok := <-p.input:
+			if !ok {
+				close(p.shutdown)
+				p.producer.AsyncClose()
+				p.drain()
+				return
+			}
+			p.producer.Input() <- &sarama.ProducerMessage{
+				Topic:    msg.Topic,
+				Value:    sarama.ByteEncoder(msg.Value),
+				Metadata: &retryMetadata{original: msg.Metadata},
+			}
+		case msg := <-p.retries:
+			// Retries are re-submitted here, through the same single
+			// consumer of p.producer.Input() that normal sends use, rather
+			// than from the backoff goroutine directly: that goroutine runs
+			// on its own schedule, and writing to Sarama's Input() from two
+			// uncoordinated goroutines could land a retried block after a
+			// later one, putting the topic out of block-number order.
+			p.producer.Input() <- msg
+		case sm, ok := <-p.producer.Successes():
+			if !ok {
+				continue
+			}
+			p.breaker.Run(func() error { return nil })
+			rm := sm.Metadata.(*retryMetadata)
+			p.successes <- &ProducerMessage{Topic: sm.Topic, Metadata: rm.original}
+		case se, ok := <-p.producer.Errors():
+			if !ok {
+				continue
+			}
+			p.handleError(se)
+		}
+	}
+}
+
+// drain keeps servicing the wrapped Sarama producer's Successes/Errors
+// channels after AsyncClose until both report closed, which is the shutdown
+// sequence Sarama's docs require: AsyncClose does not flush those channels
+// itself, so returning from loop as soon as it is called would drop whatever
+// was still in flight and leave Sarama's own goroutines blocked trying to
+// send to them.
+func (p *producerImpl) drain() {
+	successesOpen, errorsOpen := true, true
+	for successesOpen || errorsOpen {
+		select {
+		case _, ok := <-p.producer.Successes():
+			if !ok {
+				successesOpen = false
+			}
+		case _, ok := <-p.producer.Errors():
+			if !ok {
+				errorsOpen = false
+			}
+		}
+	}
+}
+
+// handleError records the failure against the circuit breaker and either
+// schedules a backed-off retry of the message or, once retries (or the
+// breaker) are exhausted, reports it as a ProducerError.
+func (p *producerImpl) handleError(se *sarama.ProducerError) {
+	rm := se.Msg.Metadata.(*retryMetadata)
+	brkErr := p.breaker.Run(func() error { return se.Err })
+
+	if brkErr == breaker.ErrBreakerOpen {
+		logger.Warningf("Kafka producer circuit breaker open, giving up on message after %d attempts", rm.attempt+1)
+		p.errors <- &ProducerError{Msg: &ProducerMessage{Topic: se.Msg.Topic, Metadata: rm.original}, Err: brkErr}
+		return
+	}
+
+	if rm.attempt >= p.retry.MaxRetries {
+		logger.Warningf("Giving up on message for topic %s after %d attempts: %s", se.Msg.Topic, rm.attempt+1, se.Err)
+		p.errors <- &ProducerError{Msg: &ProducerMessage{Topic: se.Msg.Topic, Metadata: rm.original}, Err: se.Err}
+		return
+	}
+
+	rm.attempt++
+	backoff := retryBackoff(p.retry.Backoff, rm.attempt)
+
+	logger.Debugf("Retrying message for topic %s in %s (attempt %d)", se.Msg.Topic, backoff, rm.attempt)
+	go func(msg *sarama.ProducerMessage, delay time.Duration) {
+		// Give up waiting, and don't hand the message back, if loop has
+		// already wound down: past that point nothing reads p.retries, and
+		// this goroutine would otherwise leak forever blocked on the send.
+		select {
+		case <-time.After(delay):
+		case <-p.shutdown:
+			return
+		}
+		select {
+		case p.retries <- msg:
+		case <-p.shutdown:
+		}
+	}(se.Msg, backoff)
+}
+
+// retryBackoff computes the delay before retry attempt n, doubling the base
+// delay each time and adding jitter, capped at maxRetryBackoff both to keep
+// a stuck message from waiting unreasonably long and to guard against the
+// doubling overflowing time.Duration on a large attempt count.
+func retryBackoff(base time.Duration, attempt int) time.Duration {
+	backoff := base << uint(attempt-1)
+	if backoff <= 0 || backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	return backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))
+}
+
+func (p *producerImpl) Input() chan<- *ProducerMessage     { return p.input }
+func (p *producerImpl) Successes() <-chan *ProducerMessage { return p.successes }
+func (p *producerImpl) Errors() <-chan *ProducerError      { return p.errors }
+
+// Ready reports whether the circuit breaker is closed (or half-open for a
+// probe), i.e. whether this Producer currently believes Kafka is reachable.
+func (p *producerImpl) Ready() bool {
+	return !p.breaker.Tripped()
+}
+
+// Close tells loop to wind down (which will call Sarama's AsyncClose and
+// drain its Successes/Errors itself) and waits for it to do so before
+// returning, so that AsyncClose and Close are never both called against the
+// wrapped Sarama producer.
+func (p *producerImpl) Close() error {
+	close(p.input)
+	<-p.closed
+	return nil
+}
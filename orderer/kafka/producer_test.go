@@ -0,0 +1,147 @@
+/*
+Copyright IBM Corp. 2016 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+                 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/orderer/config"
+
+	"github.com/Shopify/sarama"
+	"github.com/eapache/go-resiliency/breaker"
+)
+
+// fakeAsyncProducer stands in for a real Sarama AsyncProducer so handleError
+// can be driven without a broker to talk to.
+type fakeAsyncProducer struct {
+	input     chan *sarama.ProducerMessage
+	successes chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+}
+
+func newFakeAsyncProducer() *fakeAsyncProducer {
+	return &fakeAsyncProducer{
+		input:     make(chan *sarama.ProducerMessage, 8),
+		successes: make(chan *sarama.ProducerMessage, 8),
+		errors:    make(chan *sarama.ProducerError, 8),
+	}
+}
+
+func (f *fakeAsyncProducer) Input() chan<- *sarama.ProducerMessage     { return f.input }
+func (f *fakeAsyncProducer) Successes() <-chan *sarama.ProducerMessage { return f.successes }
+func (f *fakeAsyncProducer) Errors() <-chan *sarama.ProducerError      { return f.errors }
+func (f *fakeAsyncProducer) AsyncClose()                               { close(f.input) }
+func (f *fakeAsyncProducer) Close() error                              { return nil }
+
+func newTestProducer(retry config.Retry) *producerImpl {
+	return &producerImpl{
+		producer: newFakeAsyncProducer(),
+		retry:    retry,
+		breaker: breaker.New(
+			retry.BreakerErrorThreshold,
+			retry.BreakerSuccessThreshold,
+			retry.BreakerTimeout,
+		),
+		input:     make(chan *ProducerMessage),
+		retries:   make(chan *sarama.ProducerMessage),
+		successes: make(chan *ProducerMessage),
+		// Buffered so that handleError, called synchronously by the tests,
+		// can report a final error without a concurrent reader.
+		errors:   make(chan *ProducerError, 1),
+		shutdown: make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+func TestHandleErrorRetriesThenGivesUp(t *testing.T) {
+	p := newTestProducer(config.Retry{
+		MaxRetries:              2,
+		Backoff:                 time.Millisecond,
+		BreakerErrorThreshold:   100,
+		BreakerSuccessThreshold: 1,
+		BreakerTimeout:          time.Millisecond,
+	})
+
+	msg := &sarama.ProducerMessage{Topic: "test", Metadata: &retryMetadata{original: "orig"}}
+
+	p.handleError(&sarama.ProducerError{Msg: msg, Err: errors.New("boom")})
+	retried := <-p.retries
+	if attempt := retried.Metadata.(*retryMetadata).attempt; attempt != 1 {
+		t.Fatalf("expected attempt 1, got %d", attempt)
+	}
+
+	p.handleError(&sarama.ProducerError{Msg: retried, Err: errors.New("boom again")})
+	retried = <-p.retries
+	if attempt := retried.Metadata.(*retryMetadata).attempt; attempt != 2 {
+		t.Fatalf("expected attempt 2, got %d", attempt)
+	}
+
+	// A third failure exceeds MaxRetries: reported as an error, not retried.
+	p.handleError(&sarama.ProducerError{Msg: retried, Err: errors.New("boom final")})
+	select {
+	case perr := <-p.errors:
+		if perr.Msg.Metadata != "orig" {
+			t.Fatalf("expected original metadata to be preserved, got %v", perr.Msg.Metadata)
+		}
+	case <-p.retries:
+		t.Fatal("expected handleError to give up rather than retry again")
+	case <-time.After(time.Second):
+		t.Fatal("expected handleError to report a final error")
+	}
+}
+
+func TestHandleErrorBreakerOpensAfterThreshold(t *testing.T) {
+	p := newTestProducer(config.Retry{
+		MaxRetries:              5,
+		Backoff:                 time.Millisecond,
+		BreakerErrorThreshold:   1,
+		BreakerSuccessThreshold: 1,
+		BreakerTimeout:          time.Hour,
+	})
+
+	msg1 := &sarama.ProducerMessage{Topic: "t", Metadata: &retryMetadata{original: "m1"}}
+	p.handleError(&sarama.ProducerError{Msg: msg1, Err: errors.New("boom")})
+	<-p.retries // first failure still retries; it's what trips the breaker
+
+	msg2 := &sarama.ProducerMessage{Topic: "t", Metadata: &retryMetadata{original: "m2"}}
+	p.handleError(&sarama.ProducerError{Msg: msg2, Err: errors.New("boom again")})
+	select {
+	case perr := <-p.errors:
+		if perr.Err != breaker.ErrBreakerOpen {
+			t.Fatalf("expected breaker-open error, got %v", perr.Err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected handleError to report the breaker as open")
+	}
+}
+
+func TestRetryBackoffCapsOnOverflow(t *testing.T) {
+	d := retryBackoff(time.Hour, 40) // base << 39 overflows time.Duration
+	if d <= 0 || d > 2*maxRetryBackoff {
+		t.Fatalf("expected backoff to be capped near maxRetryBackoff, got %s", d)
+	}
+}
+
+func TestRetryBackoffGrowsWithAttempt(t *testing.T) {
+	d1 := retryBackoff(time.Millisecond, 1)
+	d2 := retryBackoff(time.Millisecond, 2)
+	if d2 <= d1 {
+		t.Fatalf("expected backoff to grow with attempt, got d1=%s d2=%s", d1, d2)
+	}
+}